@@ -0,0 +1,208 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config,ImageFilter,FirewallFilter,ISOFilter
+
+package hcloud
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/helper/communicator"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// ImageFilter lets users resolve the base image to boot the server from by
+// label selector instead of a fixed name or ID.
+type ImageFilter struct {
+	// WithSelector restricts the image search to images matching this label
+	// selector, e.g. `["type=snapshot", "os=debian"]`.
+	WithSelector []string `mapstructure:"with_selector"`
+	// MostRecent picks the most recently created image when the selector
+	// matches more than one image. Defaults to false, which makes an
+	// ambiguous match a hard error.
+	MostRecent bool `mapstructure:"most_recent"`
+}
+
+// FirewallFilter lets users resolve firewalls to attach to the build server
+// by label selector instead of a fixed name or ID.
+type FirewallFilter struct {
+	// WithSelector restricts the firewall search to firewalls matching this
+	// label selector, e.g. `["env=ci"]`.
+	WithSelector []string `mapstructure:"with_selector"`
+}
+
+// ISOFilter lets users resolve the ISO to boot the server from by label
+// selector and/or architecture instead of a fixed name or ID.
+type ISOFilter struct {
+	// WithSelector restricts the ISO search to ISOs matching this label
+	// selector, e.g. `["os=talos"]`.
+	WithSelector []string `mapstructure:"with_selector"`
+	// Architecture restricts the ISO search to a single architecture, e.g.
+	// `arm64`. Defaults to matching every architecture.
+	Architecture string `mapstructure:"architecture"`
+	// MostRecent picks the most recently created ISO when the selector
+	// matches more than one. Defaults to false, which makes an ambiguous
+	// match a hard error.
+	MostRecent bool `mapstructure:"most_recent"`
+}
+
+// PublicNetConfig controls which public IPs the build server is assigned,
+// letting users pin a pre-allocated Primary IP instead of getting an
+// ephemeral one, or disable a protocol entirely (e.g. for IPv6-only builds).
+type PublicNetConfig struct {
+	// PrimaryIPv4 (name or ID) to assign to the server instead of an
+	// ephemeral IPv4 address.
+	PrimaryIPv4 string `mapstructure:"primary_ipv4"`
+	// PrimaryIPv6 (name or ID) to assign to the server instead of an
+	// ephemeral IPv6 address.
+	PrimaryIPv6 string `mapstructure:"primary_ipv6"`
+	// EnableIPv4 controls whether the server gets a public IPv4 address at
+	// all. Defaults to true.
+	EnableIPv4 *bool `mapstructure:"enable_ipv4"`
+	// EnableIPv6 controls whether the server gets a public IPv6 address at
+	// all. Defaults to true.
+	EnableIPv6 *bool `mapstructure:"enable_ipv6"`
+}
+
+type Config struct {
+	packersdk.PackerConfig `mapstructure:",squash"`
+	Comm                   communicator.Config `mapstructure:",squash"`
+
+	// The client token to authenticate the Hetzner Cloud API calls with.
+	Token string `mapstructure:"token" required:"true"`
+
+	// The server type used to create the build server, e.g. `cx22`. Mutually
+	// exclusive with `server_types`.
+	ServerType string `mapstructure:"server_type"`
+	// ServerTypes builds one server per entry concurrently, e.g. `["cpx21",
+	// "cax11"]` to produce an x86 and an arm64 snapshot from a single
+	// invocation. Mutually exclusive with `server_type`.
+	ServerTypes []string `mapstructure:"server_types"`
+	// Changes the server type after the server has been created, before
+	// running provisioners. Useful for building on a cheap server type and
+	// snapshotting on a bigger one.
+	UpgradeServerType string `mapstructure:"upgrade_server_type"`
+
+	// The location to create the server in, e.g. `nbg1`.
+	Location string `mapstructure:"location"`
+	// The name assigned to the build server.
+	ServerName string `mapstructure:"server_name"`
+
+	// The name or ID of the image to boot the server from. Mutually
+	// exclusive with `image_filter`.
+	Image string `mapstructure:"image"`
+	// ImageFilter resolves the image to use via label selector instead of a
+	// fixed name or ID.
+	ImageFilter ImageFilter `mapstructure:"image_filter"`
+
+	// RescueMode boots the server into Hetzner's rescue system before the
+	// first reboot, e.g. `linux64`. Mutually exclusive with `iso`.
+	RescueMode string `mapstructure:"rescue"`
+
+	// ISO (name or ID) to attach and boot the build server from instead of
+	// the regular image, e.g. to install a custom OS such as NixOS, Talos
+	// or pfSense. Mutually exclusive with `rescue`.
+	ISO string `mapstructure:"iso"`
+	// ISOFilter resolves the ISO to boot from via label selector instead of
+	// a fixed name or ID.
+	ISOFilter ISOFilter `mapstructure:"iso_filter"`
+
+	// Additional SSH keys (name or ID) to authorize on the build server, on
+	// top of the one packer generates for the build.
+	SSHKeys []string `mapstructure:"ssh_keys"`
+
+	// Network IDs to attach the server to.
+	Networks []int64 `mapstructure:"networks"`
+
+	// Labels to apply to the created server.
+	ServerLabels map[string]string `mapstructure:"server_labels"`
+
+	// PublicNet controls the public IPs assigned to the build server.
+	PublicNet PublicNetConfig `mapstructure:",squash"`
+
+	// Firewalls (name or ID) to attach to the build server at creation time.
+	// Can be combined with `firewall_filter`; the results of both are
+	// merged.
+	Firewalls []string `mapstructure:"firewalls"`
+	// FirewallFilter resolves additional firewalls to attach via label
+	// selector, e.g. to apply every firewall labelled `stage=ci`.
+	FirewallFilter FirewallFilter `mapstructure:"firewall_filter"`
+
+	// PlacementGroup (name or ID) to schedule the build server into.
+	// Mutually exclusive with `create_placement_group`.
+	PlacementGroup string `mapstructure:"placement_group"`
+	// CreatePlacementGroup creates an ephemeral `spread` placement group for
+	// the duration of the build and deletes it again during Cleanup. Useful
+	// to verify at build-time that the resulting snapshot can actually be
+	// scheduled into a placement group.
+	CreatePlacementGroup bool `mapstructure:"create_placement_group"`
+
+	// APIRetryMaxDuration bounds how long we keep retrying an hcloud API
+	// call that fails with a rate-limit, conflict, or transient server
+	// error, with exponential backoff and jitter between attempts. Defaults
+	// to 5 minutes.
+	APIRetryMaxDuration time.Duration `mapstructure:"api_retry_max_duration"`
+
+	// UserData passed to the server at creation time.
+	UserData string `mapstructure:"user_data"`
+	// Path to a file whose contents are used as UserData. Mutually
+	// exclusive with `user_data`.
+	UserDataFile string `mapstructure:"user_data_file"`
+
+	ctx interpolate.Context
+}
+
+func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
+	var errs *packersdk.MultiError
+
+	if err := config.Decode(c, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &c.ctx,
+	}, raws...); err != nil {
+		return nil, err
+	}
+
+	if c.Token == "" {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("token is required"))
+	}
+	if c.ServerType == "" && len(c.ServerTypes) == 0 {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("either server_type or server_types is required"))
+	}
+	if c.ServerType != "" && len(c.ServerTypes) > 0 {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("server_type and server_types are mutually exclusive"))
+	}
+	if c.Image == "" && len(c.ImageFilter.WithSelector) == 0 {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("either image or image_filter is required"))
+	}
+	if c.Image != "" && len(c.ImageFilter.WithSelector) > 0 {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("image and image_filter are mutually exclusive"))
+	}
+	if c.UserData != "" && c.UserDataFile != "" {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("user_data and user_data_file are mutually exclusive"))
+	}
+	if len(c.ServerTypes) > 1 && (c.ISO != "" || len(c.ISOFilter.WithSelector) > 0) {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("server_types cannot be combined with iso/iso_filter: the ISO attach/detach steps only track a single server"))
+	}
+	if len(c.ServerTypes) > 1 && (c.PublicNet.PrimaryIPv4 != "" || c.PublicNet.PrimaryIPv6 != "") {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("primary_ipv4/primary_ipv6 cannot be used together with server_types, since a primary IP can only be assigned to one server"))
+	}
+	if c.RescueMode != "" && (c.ISO != "" || len(c.ISOFilter.WithSelector) > 0) {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("rescue and iso/iso_filter are mutually exclusive"))
+	}
+	if c.PublicNet.EnableIPv4 != nil && !*c.PublicNet.EnableIPv4 &&
+		c.PublicNet.EnableIPv6 != nil && !*c.PublicNet.EnableIPv6 {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("enable_ipv4 and enable_ipv6 cannot both be false: the build server would have no public IP for packer to reach it over"))
+	}
+	if c.PlacementGroup != "" && c.CreatePlacementGroup {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("placement_group and create_placement_group are mutually exclusive"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return nil, errs
+	}
+	return nil, nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package hcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// defaultAPIRetryMaxDuration is used whenever Config.APIRetryMaxDuration
+// isn't set.
+const defaultAPIRetryMaxDuration = 5 * time.Minute
+
+const maxBackoff = 30 * time.Second
+
+// withRetry calls fn, retrying with exponential backoff and jitter while it
+// fails with a rate-limit, conflict, or transient server error from hcloud.
+// A 429 during a busy CI window would otherwise abort the whole build (and
+// leak the server, since Cleanup makes the same calls and fails the same
+// way), which this is meant to ride out instead.
+func withRetry(ctx context.Context, maxDuration time.Duration, fn func() error) error {
+	if maxDuration <= 0 {
+		maxDuration = defaultAPIRetryMaxDuration
+	}
+	deadline := time.Now().Add(maxDuration)
+	backoff := 500 * time.Millisecond
+
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryableError(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("giving up after %s of retries: %s", maxDuration, err)
+		}
+
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// isRetryableError reports whether err is an hcloud.Error worth retrying:
+// rate limiting, a write conflict, or a transient 5xx.
+func isRetryableError(err error) bool {
+	var hErr hcloud.Error
+	if !errors.As(err, &hErr) {
+		return false
+	}
+	switch hErr.Code {
+	case hcloud.ErrorCodeRateLimitExceeded, hcloud.ErrorCodeConflict, hcloud.ErrorCodeServiceError:
+		return true
+	default:
+		return false
+	}
+}
+
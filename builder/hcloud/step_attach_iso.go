@@ -0,0 +1,195 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package hcloud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// stepAttachISO attaches an install ISO to the build server and reboots into
+// it, as an alternative to RescueMode. It must run after stepCreateServer so
+// that it sees the final server (after any UpgradeServerType change and the
+// subsequent power-on).
+type stepAttachISO struct {
+	attached bool
+	serverId int64
+}
+
+func (s *stepAttachISO) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	c := state.Get("config").(*Config)
+	if c.ISO == "" && len(c.ISOFilter.WithSelector) == 0 {
+		return multistep.ActionContinue
+	}
+
+	client := state.Get("hcloudClient").(*hcloud.Client)
+	ui := state.Get("ui").(packersdk.Ui)
+	serverId := state.Get("server_id").(int64)
+	server := &hcloud.Server{ID: serverId}
+
+	var iso *hcloud.ISO
+	if c.ISO != "" {
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			iso, _, err = client.ISO.Get(ctx, c.ISO)
+			return err
+		})
+		if err != nil {
+			err = fmt.Errorf("error fetching ISO %q: %s", c.ISO, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if iso == nil {
+			err := fmt.Errorf("could not find ISO: %s", c.ISO)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	} else {
+		var err error
+		iso, err = getISOWithSelectors(ctx, client, c)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	ui.Say(fmt.Sprintf("Attaching ISO %s...", iso.Name))
+	var action *hcloud.Action
+	err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		action, _, err = client.Server.AttachISO(ctx, server, iso)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("error attaching ISO: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if err := waitForAction(ctx, client, action, c); err != nil {
+		err = fmt.Errorf("error attaching ISO: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.attached = true
+	s.serverId = serverId
+
+	ui.Say("Reboot server...")
+	var resetAction *hcloud.Action
+	err = withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		resetAction, _, err = client.Server.Reset(ctx, server)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("error rebooting server: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if err := waitForAction(ctx, client, resetAction, c); err != nil {
+		err = fmt.Errorf("error rebooting server: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	var console hcloud.ServerRequestConsoleResult
+	err = withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		console, _, err = client.Server.RequestConsole(ctx, server)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("error requesting console: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	ui.Message(fmt.Sprintf("Console URL (valid once): %s", console.WSSURL))
+	state.Put("console_url", console.WSSURL)
+
+	return multistep.ActionContinue
+}
+
+// Cleanup detaches the ISO whenever the build halted after the ISO was
+// attached, as a safety net for builds that halt before the dedicated
+// stepDetachISO step runs (e.g. provisioning failure); the normal success
+// path detaches before snapshotting via stepDetachISO. Cleanup does not check
+// whether stepDetachISO already ran, so a halt after it detaches again.
+func (s *stepAttachISO) Cleanup(state multistep.StateBag) {
+	if !s.attached {
+		return
+	}
+	if _, halted := state.GetOk("error"); !halted {
+		return
+	}
+
+	client := state.Get("hcloudClient").(*hcloud.Client)
+	ui := state.Get("ui").(packersdk.Ui)
+	c := state.Get("config").(*Config)
+
+	ui.Say("Detaching ISO...")
+	var action *hcloud.Action
+	err := withRetry(context.TODO(), c.APIRetryMaxDuration, func() error {
+		var err error
+		action, _, err = client.Server.DetachISO(context.TODO(), &hcloud.Server{ID: s.serverId})
+		return err
+	})
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error detaching ISO. Please detach it manually: %s", err))
+		return
+	}
+	if err := waitForAction(context.TODO(), client, action, c); err != nil {
+		ui.Error(fmt.Sprintf("Error detaching ISO. Please detach it manually: %s", err))
+	}
+}
+
+// stepDetachISO detaches the install ISO again once provisioning has
+// finished. It must be placed right before the snapshot step in the build's
+// step list, so the snapshot does not capture a disk with the ISO attached.
+type stepDetachISO struct{}
+
+func (s *stepDetachISO) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	c := state.Get("config").(*Config)
+	if c.ISO == "" && len(c.ISOFilter.WithSelector) == 0 {
+		return multistep.ActionContinue
+	}
+
+	client := state.Get("hcloudClient").(*hcloud.Client)
+	ui := state.Get("ui").(packersdk.Ui)
+	serverId := state.Get("server_id").(int64)
+
+	ui.Say("Detaching ISO...")
+	var action *hcloud.Action
+	err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		action, _, err = client.Server.DetachISO(ctx, &hcloud.Server{ID: serverId})
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("error detaching ISO: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if err := waitForAction(ctx, client, action, c); err != nil {
+		err = fmt.Errorf("error detaching ISO: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *stepDetachISO) Cleanup(state multistep.StateBag) {}
@@ -7,8 +7,10 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
@@ -16,7 +18,16 @@ import (
 )
 
 type stepCreateServer struct {
-	serverId int64
+	// serverIds is keyed by server type name, so Cleanup can destroy every
+	// server the step created, even if only some of a multi-arch build
+	// succeeded.
+	serverIds map[string]int64
+
+	// placementGroupId and createdPlacementGroup are only set when we
+	// auto-created an ephemeral placement group, so Cleanup knows to tear
+	// it back down.
+	placementGroupId      int64
+	createdPlacementGroup bool
 }
 
 func (s *stepCreateServer) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -25,8 +36,17 @@ func (s *stepCreateServer) Run(ctx context.Context, state multistep.StateBag) mu
 	c := state.Get("config").(*Config)
 	sshKeyId := state.Get("ssh_key_id").(int64)
 
-	// Create the server based on configuration
-	ui.Say("Creating server...")
+	serverTypes := c.ServerTypes
+	if len(serverTypes) == 0 {
+		serverTypes = []string{c.ServerType}
+	}
+	multiArch := len(serverTypes) > 1
+
+	if multiArch {
+		ui.Say(fmt.Sprintf("Creating %d servers (%s)...", len(serverTypes), strings.Join(serverTypes, ", ")))
+	} else {
+		ui.Say("Creating server...")
+	}
 
 	userData := c.UserData
 	if c.UserDataFile != "" {
@@ -41,7 +61,12 @@ func (s *stepCreateServer) Run(ctx context.Context, state multistep.StateBag) mu
 
 	sshKeys := []*hcloud.SSHKey{{ID: sshKeyId}}
 	for _, k := range c.SSHKeys {
-		sshKey, _, err := client.SSHKey.Get(ctx, k)
+		var sshKey *hcloud.SSHKey
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			sshKey, _, err = client.SSHKey.Get(ctx, k)
+			return err
+		})
 		if err != nil {
 			ui.Error(err.Error())
 			state.Put("error", fmt.Errorf("Error fetching SSH key: %s", err))
@@ -54,206 +79,392 @@ func (s *stepCreateServer) Run(ctx context.Context, state multistep.StateBag) mu
 		sshKeys = append(sshKeys, sshKey)
 	}
 
+	var networks []*hcloud.Network
+	for _, k := range c.Networks {
+		networks = append(networks, &hcloud.Network{ID: k})
+	}
+
+	firewalls, err := getFirewalls(ctx, client, c)
+	if err != nil {
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	placementGroup, err := s.getPlacementGroup(ctx, client, c, ui)
+	if err != nil {
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	publicNet, err := getPublicNet(ctx, client, c)
+	if err != nil {
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	type createResult struct {
+		serverType string
+		server     *hcloud.Server
+		err        error
+	}
+
+	results := make(chan createResult, len(serverTypes))
+	var wg sync.WaitGroup
+	for _, serverTypeName := range serverTypes {
+		wg.Add(1)
+		go func(serverTypeName string) {
+			defer wg.Done()
+			server, err := s.createOne(ctx, client, ui, c, serverTypeName, multiArch, sshKeys, userData, networks, firewalls, placementGroup, publicNet)
+			results <- createResult{serverType: serverTypeName, server: server, err: err}
+		}(serverTypeName)
+	}
+	wg.Wait()
+	close(results)
+
+	createdIds := make(map[string]int64)
+	serverIds := make(map[string]int64)
+	serverIps := make(map[string]string)
+	var firstErr error
+	for r := range results {
+		// r.server is non-nil as soon as Server.Create succeeds, even if a
+		// later step (waitForAction, UpgradeServerType, RescueMode) fails,
+		// so track it for Cleanup regardless of r.err.
+		if r.server != nil {
+			createdIds[r.serverType] = r.server.ID
+		}
+		if r.err != nil {
+			ui.Error(r.err.Error())
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		serverIds[r.serverType] = r.server.ID
+		serverIps[r.serverType] = serverIP(c, r.server)
+	}
+	// We use this in Cleanup, so that a server that was created but then
+	// failed a later step (rather than failing outright) still gets
+	// destroyed instead of leaked.
+	s.serverIds = createdIds
+
+	if firstErr != nil {
+		state.Put("error", firstErr)
+		return multistep.ActionHalt
+	}
+
+	state.Put("server_ids", serverIds)
+	state.Put("server_ips", serverIps)
+	if !multiArch {
+		id := serverIds[serverTypes[0]]
+		state.Put("server_id", id)
+		// instance_id is the generic term used so that users can have access to the
+		// instance id inside of the provisioners, used in step_provision.
+		state.Put("instance_id", id)
+		state.Put("server_ip", serverIps[serverTypes[0]])
+	}
+
+	return multistep.ActionContinue
+}
+
+// createOne creates a single server of the given server type, following it
+// through image resolution, UpgradeServerType and RescueMode, the same way
+// the single-architecture path always has. It runs concurrently with its
+// siblings when multiArch is set, so it must not mutate shared state besides
+// its own return value.
+func (s *stepCreateServer) createOne(ctx context.Context, client *hcloud.Client, ui packersdk.Ui, c *Config, serverTypeName string, multiArch bool, sshKeys []*hcloud.SSHKey, userData string, networks []*hcloud.Network, firewalls []*hcloud.ServerCreateFirewall, placementGroup *hcloud.PlacementGroup, publicNet *hcloud.ServerCreatePublicNet) (*hcloud.Server, error) {
+	var serverType *hcloud.ServerType
+	err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		serverType, _, err = client.ServerType.Get(ctx, serverTypeName)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching server type %q: %s", serverTypeName, err)
+	}
+	if serverType == nil {
+		return nil, fmt.Errorf("could not find server type: %s", serverTypeName)
+	}
+
 	var image *hcloud.Image
 	if c.Image != "" {
 		image = &hcloud.Image{Name: c.Image}
 	} else {
-		serverType := state.Get("serverType").(*hcloud.ServerType)
-		var err error
 		image, err = getImageWithSelectors(ctx, client, c, serverType)
 		if err != nil {
-			ui.Error(err.Error())
-			state.Put("error", err)
-			return multistep.ActionHalt
+			return nil, err
 		}
-		ui.Message(fmt.Sprintf("Using image %s with ID %d", image.Description, image.ID))
+		ui.Message(fmt.Sprintf("[%s] Using image %s with ID %d", serverTypeName, image.Description, image.ID))
 	}
 
-	var networks []*hcloud.Network
-	for _, k := range c.Networks {
-		networks = append(networks, &hcloud.Network{ID: k})
+	name := c.ServerName
+	labels := c.ServerLabels
+	if multiArch {
+		name = fmt.Sprintf("%s-%s", c.ServerName, serverTypeName)
+		labels = withArchLabel(c.ServerLabels, serverType.Architecture)
 	}
 
 	serverCreateOpts := hcloud.ServerCreateOpts{
-		Name:       c.ServerName,
-		ServerType: &hcloud.ServerType{Name: c.ServerType},
-		Image:      image,
-		SSHKeys:    sshKeys,
-		Location:   &hcloud.Location{Name: c.Location},
-		UserData:   userData,
-		Networks:   networks,
-		Labels:     c.ServerLabels,
+		Name:           name,
+		ServerType:     serverType,
+		Image:          image,
+		SSHKeys:        sshKeys,
+		Location:       &hcloud.Location{Name: c.Location},
+		UserData:       userData,
+		Networks:       networks,
+		Labels:         labels,
+		Firewalls:      firewalls,
+		PlacementGroup: placementGroup,
+		PublicNet:      publicNet,
 	}
 
 	if c.UpgradeServerType != "" {
 		serverCreateOpts.StartAfterCreate = hcloud.Bool(false)
 	}
 
-	serverCreateResult, _, err := client.Server.Create(ctx, serverCreateOpts)
+	var result hcloud.ServerCreateResult
+	err = withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		result, _, err = client.Server.Create(ctx, serverCreateOpts)
+		return err
+	})
 	if err != nil {
-		err := fmt.Errorf("Error creating server: %s", err)
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+		return nil, fmt.Errorf("Error creating server (%s): %s", serverTypeName, err)
 	}
-	state.Put("server_ip", serverCreateResult.Server.PublicNet.IPv4.IP.String())
-	// We use this in cleanup
-	s.serverId = serverCreateResult.Server.ID
-
-	// Store the server id for later
-	state.Put("server_id", serverCreateResult.Server.ID)
-	// instance_id is the generic term used so that users can have access to the
-	// instance id inside of the provisioners, used in step_provision.
-	state.Put("instance_id", serverCreateResult.Server.ID)
+	server := result.Server
 
-	if err := waitForAction(ctx, client, serverCreateResult.Action); err != nil {
-		err := fmt.Errorf("Error creating server: %s", err)
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+	if err := waitForAction(ctx, client, result.Action, c); err != nil {
+		return server, fmt.Errorf("Error creating server (%s): %s", serverTypeName, err)
 	}
-	for _, nextAction := range serverCreateResult.NextActions {
-		if err := waitForAction(ctx, client, nextAction); err != nil {
-			err := fmt.Errorf("Error creating server: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+	for _, nextAction := range result.NextActions {
+		if err := waitForAction(ctx, client, nextAction, c); err != nil {
+			return server, fmt.Errorf("Error creating server (%s): %s", serverTypeName, err)
 		}
 	}
 
 	if c.UpgradeServerType != "" {
-		ui.Say("Changing server-type...")
-		serverChangeTypeAction, _, err := client.Server.ChangeType(ctx, serverCreateResult.Server, hcloud.ServerChangeTypeOpts{
-			ServerType:  &hcloud.ServerType{Name: c.UpgradeServerType},
-			UpgradeDisk: false,
+		ui.Say(fmt.Sprintf("[%s] Changing server-type...", serverTypeName))
+		var serverChangeTypeAction *hcloud.Action
+		err = withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			serverChangeTypeAction, _, err = client.Server.ChangeType(ctx, server, hcloud.ServerChangeTypeOpts{
+				ServerType:  &hcloud.ServerType{Name: c.UpgradeServerType},
+				UpgradeDisk: false,
+			})
+			return err
 		})
 		if err != nil {
-			err := fmt.Errorf("Error changing server-type: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+			return server, fmt.Errorf("Error changing server-type (%s): %s", serverTypeName, err)
 		}
-
-		if err := waitForAction(ctx, client, serverChangeTypeAction); err != nil {
-			err := fmt.Errorf("Error changing server-type: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+		if err := waitForAction(ctx, client, serverChangeTypeAction, c); err != nil {
+			return server, fmt.Errorf("Error changing server-type (%s): %s", serverTypeName, err)
 		}
 
-		ui.Say("Starting server...")
-		serverPoweronAction, _, err := client.Server.Poweron(ctx, serverCreateResult.Server)
+		ui.Say(fmt.Sprintf("[%s] Starting server...", serverTypeName))
+		var serverPoweronAction *hcloud.Action
+		err = withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			serverPoweronAction, _, err = client.Server.Poweron(ctx, server)
+			return err
+		})
 		if err != nil {
-			err := fmt.Errorf("Error starting server: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+			return server, fmt.Errorf("Error starting server (%s): %s", serverTypeName, err)
 		}
-
-		if err := waitForAction(ctx, client, serverPoweronAction); err != nil {
-			err := fmt.Errorf("Error starting server: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+		if err := waitForAction(ctx, client, serverPoweronAction, c); err != nil {
+			return server, fmt.Errorf("Error starting server (%s): %s", serverTypeName, err)
 		}
 	}
 
 	if c.RescueMode != "" {
-		ui.Say("Enabling Rescue Mode...")
-		_, err := setRescue(ctx, client, serverCreateResult.Server, c.RescueMode, sshKeys)
-		if err != nil {
-			err := fmt.Errorf("Error enabling rescue mode: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+		ui.Say(fmt.Sprintf("[%s] Enabling Rescue Mode...", serverTypeName))
+		if _, err := setRescue(ctx, client, server, c.RescueMode, sshKeys, c); err != nil {
+			return server, fmt.Errorf("Error enabling rescue mode (%s): %s", serverTypeName, err)
 		}
-		ui.Say("Reboot server...")
-		action, _, err := client.Server.Reset(ctx, serverCreateResult.Server)
+		ui.Say(fmt.Sprintf("[%s] Reboot server...", serverTypeName))
+		var action *hcloud.Action
+		err = withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			action, _, err = client.Server.Reset(ctx, server)
+			return err
+		})
 		if err != nil {
-			err := fmt.Errorf("Error rebooting server: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+			return server, fmt.Errorf("Error rebooting server (%s): %s", serverTypeName, err)
 		}
-		if err := waitForAction(ctx, client, action); err != nil {
-			err := fmt.Errorf("Error rebooting server: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+		if err := waitForAction(ctx, client, action, c); err != nil {
+			return server, fmt.Errorf("Error rebooting server (%s): %s", serverTypeName, err)
 		}
 	}
 
-	return multistep.ActionContinue
+	return server, nil
 }
 
 func (s *stepCreateServer) Cleanup(state multistep.StateBag) {
-	// If the serverID isn't there, we probably never created it
-	if s.serverId == 0 {
+	// If serverIds is empty and no placement group was created, we probably
+	// never created anything
+	if len(s.serverIds) == 0 && !s.createdPlacementGroup {
 		return
 	}
 
 	client := state.Get("hcloudClient").(*hcloud.Client)
 	ui := state.Get("ui").(packersdk.Ui)
+	c := state.Get("config").(*Config)
+
+	// Destroy the servers we just created
+	if len(s.serverIds) > 0 {
+		ui.Say("Destroying server(s)...")
+	}
+	for _, serverId := range s.serverIds {
+		err := withRetry(context.TODO(), c.APIRetryMaxDuration, func() error {
+			_, err := client.Server.Delete(context.TODO(), &hcloud.Server{ID: serverId})
+			return err
+		})
+		if err != nil {
+			ui.Error(fmt.Sprintf(
+				"Error destroying server. Please destroy it manually: %s", err))
+		}
+	}
+
+	if s.createdPlacementGroup {
+		ui.Say("Destroying placement group...")
+		err := withRetry(context.TODO(), c.APIRetryMaxDuration, func() error {
+			_, err := client.PlacementGroup.Delete(context.TODO(), &hcloud.PlacementGroup{ID: s.placementGroupId})
+			return err
+		})
+		if err != nil {
+			ui.Error(fmt.Sprintf(
+				"Error destroying placement group. Please destroy it manually: %s", err))
+		}
+	}
+}
+
+// withArchLabel returns labels with an added "arch" entry, used to tell
+// apart the servers of a multi-architecture build (e.g. "arch=arm64").
+func withArchLabel(labels map[string]string, arch hcloud.Architecture) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out["arch"] = string(arch)
+	return out
+}
 
-	// Destroy the server we just created
-	ui.Say("Destroying server...")
-	_, err := client.Server.Delete(context.TODO(), &hcloud.Server{ID: s.serverId})
+// getPlacementGroup resolves c.PlacementGroup, or auto-creates an ephemeral
+// spread placement group when c.CreatePlacementGroup is set. The created
+// group's ID is stashed on the step so Cleanup can delete it again.
+func (s *stepCreateServer) getPlacementGroup(ctx context.Context, client *hcloud.Client, c *Config, ui packersdk.Ui) (*hcloud.PlacementGroup, error) {
+	if c.PlacementGroup != "" {
+		var placementGroup *hcloud.PlacementGroup
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			placementGroup, _, err = client.PlacementGroup.Get(ctx, c.PlacementGroup)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching placement group %q: %s", c.PlacementGroup, err)
+		}
+		if placementGroup == nil {
+			return nil, fmt.Errorf("could not find placement group: %s", c.PlacementGroup)
+		}
+		return placementGroup, nil
+	}
+
+	if !c.CreatePlacementGroup {
+		return nil, nil
+	}
+
+	ui.Say("Creating placement group...")
+	// Packer sets PACKER_RUN_UUID to a value unique to this build invocation,
+	// so the name stays unique across reruns of the same config (e.g. CI
+	// retries); c.ServerName alone is a static, user-supplied value and would
+	// collide with the prior run's already-cleaned-up group.
+	name := fmt.Sprintf("packer-%s-%s", c.ServerName, os.Getenv("PACKER_RUN_UUID"))
+	var result hcloud.PlacementGroupCreateResult
+	err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		result, _, err = client.PlacementGroup.Create(ctx, hcloud.PlacementGroupCreateOpts{
+			Name: name,
+			Type: hcloud.PlacementGroupTypeSpread,
+		})
+		return err
+	})
 	if err != nil {
-		ui.Error(fmt.Sprintf(
-			"Error destroying server. Please destroy it manually: %s", err))
+		return nil, fmt.Errorf("error creating placement group: %s", err)
+	}
+	s.placementGroupId = result.PlacementGroup.ID
+	s.createdPlacementGroup = true
+	if result.Action != nil {
+		if err := waitForAction(ctx, client, result.Action, c); err != nil {
+			return nil, fmt.Errorf("error creating placement group: %s", err)
+		}
 	}
+
+	return result.PlacementGroup, nil
 }
 
-func setRescue(ctx context.Context, client *hcloud.Client, server *hcloud.Server, rescue string, sshKeys []*hcloud.SSHKey) (string, error) {
+func setRescue(ctx context.Context, client *hcloud.Client, server *hcloud.Server, rescue string, sshKeys []*hcloud.SSHKey, c *Config) (string, error) {
 	rescueChanged := false
 	if server.RescueEnabled {
 		rescueChanged = true
-		action, _, err := client.Server.DisableRescue(ctx, server)
+		var action *hcloud.Action
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			action, _, err = client.Server.DisableRescue(ctx, server)
+			return err
+		})
 		if err != nil {
 			return "", err
 		}
-		if err := waitForAction(ctx, client, action); err != nil {
+		if err := waitForAction(ctx, client, action, c); err != nil {
 			return "", err
 		}
 	}
 
 	if rescue != "" {
-		res, _, err := client.Server.EnableRescue(ctx, server, hcloud.ServerEnableRescueOpts{
-			Type:    hcloud.ServerRescueType(rescue),
-			SSHKeys: sshKeys,
+		var res hcloud.ServerEnableRescueResult
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			res, _, err = client.Server.EnableRescue(ctx, server, hcloud.ServerEnableRescueOpts{
+				Type:    hcloud.ServerRescueType(rescue),
+				SSHKeys: sshKeys,
+			})
+			return err
 		})
 		if err != nil {
 			return "", err
 		}
-		if err := waitForAction(ctx, client, res.Action); err != nil {
+		if err := waitForAction(ctx, client, res.Action, c); err != nil {
 			return "", err
 		}
 		return res.RootPassword, nil
 	}
 
 	if rescueChanged {
-		action, _, err := client.Server.Reset(ctx, server)
+		var action *hcloud.Action
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			action, _, err = client.Server.Reset(ctx, server)
+			return err
+		})
 		if err != nil {
 			return "", err
 		}
-		if err := waitForAction(ctx, client, action); err != nil {
+		if err := waitForAction(ctx, client, action, c); err != nil {
 			return "", err
 		}
 	}
 	return "", nil
 }
 
-func waitForAction(ctx context.Context, client *hcloud.Client, action *hcloud.Action) error {
-	_, errCh := client.Action.WatchProgress(ctx, action)
-	if err := <-errCh; err != nil {
-		return err
-	}
-	return nil
+func waitForAction(ctx context.Context, client *hcloud.Client, action *hcloud.Action, c *Config) error {
+	return withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		_, errCh := client.Action.WatchProgress(ctx, action)
+		return <-errCh
+	})
 }
 
 func getImageWithSelectors(ctx context.Context, client *hcloud.Client, c *Config, serverType *hcloud.ServerType) (*hcloud.Image, error) {
-	var allImages []*hcloud.Image
-
 	selector := strings.Join(c.ImageFilter.WithSelector, ",")
 	opts := hcloud.ImageListOpts{
 		ListOpts:     hcloud.ListOpts{LabelSelector: selector},
@@ -261,7 +472,12 @@ func getImageWithSelectors(ctx context.Context, client *hcloud.Client, c *Config
 		Architecture: []hcloud.Architecture{serverType.Architecture},
 	}
 
-	allImages, err := client.Image.AllWithOpts(ctx, opts)
+	var allImages []*hcloud.Image
+	err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		allImages, err = client.Image.AllWithOpts(ctx, opts)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -280,3 +496,159 @@ func getImageWithSelectors(ctx context.Context, client *hcloud.Client, c *Config
 
 	return allImages[0], nil
 }
+
+func getISOWithSelectors(ctx context.Context, client *hcloud.Client, c *Config) (*hcloud.ISO, error) {
+	selector := strings.Join(c.ISOFilter.WithSelector, ",")
+	opts := hcloud.ISOListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: selector},
+	}
+	if c.ISOFilter.Architecture != "" {
+		opts.Architecture = []hcloud.Architecture{hcloud.Architecture(c.ISOFilter.Architecture)}
+	}
+
+	var allISOs []*hcloud.ISO
+	err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+		var err error
+		allISOs, err = client.ISO.AllWithOpts(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(allISOs) == 0 {
+		return nil, fmt.Errorf("no ISO found for selector %q", selector)
+	}
+	if len(allISOs) > 1 {
+		if !c.ISOFilter.MostRecent {
+			return nil, fmt.Errorf("more than one ISO found for selector %q", selector)
+		}
+
+		sort.Slice(allISOs, func(i, j int) bool {
+			return allISOs[i].Created.After(allISOs[j].Created)
+		})
+	}
+
+	return allISOs[0], nil
+}
+
+// getPublicNet resolves c.PublicNet into ServerCreateOpts' PublicNet, looking
+// up any pinned Primary IPs by name or ID. A nil return leaves the server on
+// hcloud's default public networking (an ephemeral IPv4 and IPv6 each).
+func getPublicNet(ctx context.Context, client *hcloud.Client, c *Config) (*hcloud.ServerCreatePublicNet, error) {
+	pn := c.PublicNet
+	if pn.PrimaryIPv4 == "" && pn.PrimaryIPv6 == "" && pn.EnableIPv4 == nil && pn.EnableIPv6 == nil {
+		return nil, nil
+	}
+
+	publicNet := &hcloud.ServerCreatePublicNet{
+		EnableIPv4: pn.EnableIPv4 == nil || *pn.EnableIPv4,
+		EnableIPv6: pn.EnableIPv6 == nil || *pn.EnableIPv6,
+	}
+
+	if pn.PrimaryIPv4 != "" {
+		var ip *hcloud.PrimaryIP
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			ip, _, err = client.PrimaryIP.Get(ctx, pn.PrimaryIPv4)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching primary IPv4 %q: %s", pn.PrimaryIPv4, err)
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("could not find primary IPv4: %s", pn.PrimaryIPv4)
+		}
+		publicNet.IPv4 = ip
+	}
+
+	if pn.PrimaryIPv6 != "" {
+		var ip *hcloud.PrimaryIP
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			ip, _, err = client.PrimaryIP.Get(ctx, pn.PrimaryIPv6)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching primary IPv6 %q: %s", pn.PrimaryIPv6, err)
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("could not find primary IPv6: %s", pn.PrimaryIPv6)
+		}
+		publicNet.IPv6 = ip
+	}
+
+	return publicNet, nil
+}
+
+// serverIP picks the address provisioners should use to reach the server:
+// the explicitly assigned primary IP if there is one, falling back to
+// whatever public IP hcloud actually handed out, preferring IPv4 unless it
+// was disabled.
+func serverIP(c *Config, server *hcloud.Server) string {
+	if c.PublicNet.PrimaryIPv4 != "" {
+		return server.PublicNet.IPv4.IP.String()
+	}
+	if c.PublicNet.PrimaryIPv6 != "" {
+		return server.PublicNet.IPv6.IP.String()
+	}
+	if c.PublicNet.EnableIPv4 == nil || *c.PublicNet.EnableIPv4 {
+		return server.PublicNet.IPv4.IP.String()
+	}
+	return server.PublicNet.IPv6.IP.String()
+}
+
+// getFirewalls resolves c.Firewalls (by ID or name) and c.FirewallFilter.WithSelector
+// (by label selector) into the set of firewalls to attach to the server at
+// creation time. Since the server is destroyed during Cleanup, the firewalls
+// themselves never need to be detached.
+func getFirewalls(ctx context.Context, client *hcloud.Client, c *Config) ([]*hcloud.ServerCreateFirewall, error) {
+	seen := make(map[int64]bool)
+	var firewalls []*hcloud.ServerCreateFirewall
+
+	add := func(f *hcloud.Firewall) {
+		if f == nil || seen[f.ID] {
+			return
+		}
+		seen[f.ID] = true
+		firewalls = append(firewalls, &hcloud.ServerCreateFirewall{Firewall: hcloud.Firewall{ID: f.ID}})
+	}
+
+	for _, idOrName := range c.Firewalls {
+		var firewall *hcloud.Firewall
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			firewall, _, err = client.Firewall.Get(ctx, idOrName)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching firewall %q: %s", idOrName, err)
+		}
+		if firewall == nil {
+			return nil, fmt.Errorf("could not find firewall: %s", idOrName)
+		}
+		add(firewall)
+	}
+
+	if len(c.FirewallFilter.WithSelector) > 0 {
+		selector := strings.Join(c.FirewallFilter.WithSelector, ",")
+		var matches []*hcloud.Firewall
+		err := withRetry(ctx, c.APIRetryMaxDuration, func() error {
+			var err error
+			matches, err = client.Firewall.AllWithOpts(ctx, hcloud.FirewallListOpts{
+				ListOpts: hcloud.ListOpts{LabelSelector: selector},
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching firewalls for selector %q: %s", selector, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no firewall found for selector %q", selector)
+		}
+		for _, firewall := range matches {
+			add(firewall)
+		}
+	}
+
+	return firewalls, nil
+}